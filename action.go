@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// ActionMode selects what processGroup does with the non-survivor members
+// of a duplicate group once SlowHash has confirmed them identical.
+type ActionMode string
+
+const (
+	actionPrint    ActionMode = "print"
+	actionHardlink ActionMode = "hardlink"
+	actionReflink  ActionMode = "reflink"
+	actionSymlink  ActionMode = "symlink"
+	actionDelete   ActionMode = "delete"
+)
+
+// lookupActionMode resolves a -action flag value to an ActionMode.
+func lookupActionMode(name string) (ActionMode, error) {
+	switch ActionMode(name) {
+	case actionPrint, actionHardlink, actionReflink, actionSymlink, actionDelete:
+		return ActionMode(name), nil
+	}
+	return "", fmt.Errorf("unknown action %q", name)
+}
+
+// KeepPolicy decides which member of a duplicate group survives when
+// action replaces the others.
+type KeepPolicy string
+
+const (
+	keepFirst        KeepPolicy = "first"
+	keepShortestPath KeepPolicy = "shortest-path"
+	keepOldest       KeepPolicy = "oldest"
+	keepNewest       KeepPolicy = "newest"
+)
+
+// lookupKeepPolicy resolves a -keep flag value to a KeepPolicy.
+func lookupKeepPolicy(name string) (KeepPolicy, error) {
+	switch KeepPolicy(name) {
+	case keepFirst, keepShortestPath, keepOldest, keepNewest:
+		return KeepPolicy(name), nil
+	}
+	return "", fmt.Errorf("unknown -keep policy %q", name)
+}
+
+var (
+	// actionMode is print unless -action picks something else, so the
+	// default invocation still just lists duplicate groups.
+	actionMode ActionMode = actionPrint
+	keepPolicy KeepPolicy = keepFirst
+	// dryRun, when true, runs every check an action would but performs no
+	// filesystem mutation.
+	dryRun bool
+)
+
+// GroupReport records what processGroup did with one duplicate group.
+type GroupReport struct {
+	Survivor       string   `json:"survivor"`
+	Removed        []string `json:"removed,omitempty"`
+	Skipped        []string `json:"skipped,omitempty"`
+	BytesReclaimed int64    `json:"bytesReclaimed"`
+}
+
+// Report is the machine-readable summary written by -report.
+type Report struct {
+	Action         ActionMode    `json:"action"`
+	Keep           KeepPolicy    `json:"keep"`
+	DryRun         bool          `json:"dryRun"`
+	Groups         []GroupReport `json:"groups"`
+	BytesReclaimed int64         `json:"bytesReclaimed"`
+}
+
+var actionReport Report
+
+// chooseSurvivor picks the group member that action leaves untouched,
+// per keepPolicy. aliases is assumed non-empty.
+func chooseSurvivor(aliases []*File) *File {
+	survivor := aliases[0]
+	for _, file := range aliases[1:] {
+		if survivorBeats(file, survivor) {
+			survivor = file
+		}
+	}
+	return survivor
+}
+
+func survivorBeats(file, survivor *File) bool {
+	switch keepPolicy {
+	case keepShortestPath:
+		return len(file.Path) < len(survivor.Path)
+	case keepOldest:
+		return file.Mtime < survivor.Mtime
+	case keepNewest:
+		return file.Mtime > survivor.Mtime
+	default: // keepFirst
+		return false
+	}
+}
+
+// processGroup handles one confirmed-duplicate group discovered by
+// analyze. In actionPrint mode it just prints paths - the original
+// behavior. Otherwise it keeps the survivor chosen by keepPolicy and
+// replaces every other member per actionMode, recording the outcome in
+// actionReport.
+func processGroup(dirname string, aliases []*File) {
+	if actionMode == actionPrint {
+		for _, file := range aliases {
+			fmt.Printf("%s\n", file.Path[len(dirname):])
+		}
+		fmt.Printf("\n")
+		return
+	}
+
+	survivor := chooseSurvivor(aliases)
+	gr := GroupReport{Survivor: survivor.Path[len(dirname):]}
+	for _, file := range aliases {
+		if file == survivor {
+			continue
+		}
+		if err := replaceFile(survivor, file); err != nil {
+			gr.Skipped = append(gr.Skipped, fmt.Sprintf("%s: %s", file.Path[len(dirname):], err))
+			continue
+		}
+		gr.Removed = append(gr.Removed, file.Path[len(dirname):])
+		gr.BytesReclaimed += file.Size
+	}
+	actionReport.Groups = append(actionReport.Groups, gr)
+	actionReport.BytesReclaimed += gr.BytesReclaimed
+}
+
+// replaceFile makes dup's path resolve to survivor's content (or removes
+// it outright for actionDelete), refusing to do so if the two files live
+// on different filesystems (hardlink/reflink only) or if dup has changed
+// since its SlowHash was computed.
+func replaceFile(survivor, dup *File) error {
+	if survivor.Ino != 0 && survivor.Dev == dup.Dev && survivor.Ino == dup.Ino {
+		return fmt.Errorf("already the same file (pre-existing hardlink)")
+	}
+	if actionMode == actionHardlink || actionMode == actionReflink {
+		if survivor.Dev != dup.Dev {
+			return fmt.Errorf("refusing to %s across filesystems", actionMode)
+		}
+	}
+	if err := checkUnmodified(dup); err != nil {
+		return err
+	}
+	if dryRun {
+		return nil
+	}
+	switch actionMode {
+	case actionHardlink:
+		return atomicReplace(dup.Path, func(tmp string) error {
+			return os.Link(survivor.Path, tmp)
+		})
+	case actionReflink:
+		dupInfo, err := os.Lstat(dup.Path)
+		if err != nil {
+			return err
+		}
+		return atomicReplace(dup.Path, func(tmp string) error {
+			return reflink(survivor.Path, tmp, dupInfo.Mode().Perm())
+		})
+	case actionSymlink:
+		return atomicReplace(dup.Path, func(tmp string) error {
+			target, err := symlinkTarget(survivor.Path, dup.Path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(target, tmp)
+		})
+	case actionDelete:
+		return os.Remove(dup.Path)
+	}
+	return fmt.Errorf("unknown action %q", actionMode)
+}
+
+// symlinkTarget returns what a symlink replacing dupPath should point at
+// to resolve to survivorPath. A symlink's target is resolved relative to
+// the symlink's own directory, not the process's cwd, so survivorPath
+// can't be used verbatim unless the two happen to be siblings; fall back
+// to an absolute path if they don't share a common base.
+func symlinkTarget(survivorPath, dupPath string) (string, error) {
+	rel, err := filepath.Rel(filepath.Dir(dupPath), survivorPath)
+	if err != nil {
+		return filepath.Abs(survivorPath)
+	}
+	return rel, nil
+}
+
+// checkUnmodified re-stats file and refuses it if it has changed since
+// SlowHash was computed, since the cached hash can no longer be trusted.
+func checkUnmodified(file *File) error {
+	fileinfo, err := os.Lstat(file.Path)
+	if err != nil {
+		return err
+	}
+	if fileinfo.Size() != file.Size || fileinfo.ModTime().UnixNano() != file.Mtime {
+		return fmt.Errorf("modified since it was hashed, skipping")
+	}
+	return nil
+}
+
+// atomicReplace builds the replacement at a temp name beside target via
+// build, then swaps it into place: renameat2(RENAME_EXCHANGE) where the
+// kernel supports it, so target is never briefly missing, falling back to
+// a plain rename (which atomically replaces and implicitly unlinks the
+// old target) where it doesn't.
+func atomicReplace(target string, build func(tmp string) error) error {
+	tmp := fmt.Sprintf("%s.same-tmp-%d", target, os.Getpid())
+	os.Remove(tmp)
+	if err := build(tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err := unix.Renameat2(unix.AT_FDCWD, tmp, unix.AT_FDCWD, target, unix.RENAME_EXCHANGE)
+	if err == nil {
+		return os.Remove(tmp)
+	}
+	if !errors.Is(err, unix.ENOSYS) && !errors.Is(err, unix.EINVAL) {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, target)
+}
+
+// reflink creates dst as a copy-on-write clone of src via the Linux
+// FICLONE ioctl, so the two share storage until one of them is modified.
+// dst is given perm rather than inheriting umask-masked defaults, so the
+// clone keeps the permission bits of the file it's replacing.
+func reflink(src, dst string, perm os.FileMode) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	dstFile, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	defer dstFile.Close()
+	if err := unix.IoctlFileClone(int(dstFile.Fd()), int(srcFile.Fd())); err != nil {
+		return err
+	}
+	return dstFile.Chmod(perm)
+}
+
+// writeReport marshals actionReport as JSON to name, or to stdout if name
+// is "-".
+func writeReport(name string) error {
+	actionReport.Action = actionMode
+	actionReport.Keep = keepPolicy
+	actionReport.DryRun = dryRun
+	data, err := json.MarshalIndent(&actionReport, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if name == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(name, data, 0644)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// resetActionState clears the package-level action config tests mutate.
+func resetActionState(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		actionMode = actionPrint
+		keepPolicy = keepFirst
+		dryRun = false
+		actionReport = Report{}
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// TestReplaceFileSymlinkTargetResolvesFromDupDir guards against a symlink
+// replacement using the survivor's path verbatim, which only resolves
+// correctly when survivor and the duplicate happen to be siblings.
+func TestReplaceFileSymlinkTargetResolvesFromDupDir(t *testing.T) {
+	resetActionState(t)
+	actionMode = actionSymlink
+
+	root := t.TempDir()
+	sub := filepath.Join(root, "subdir")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	survivorPath := filepath.Join(root, "b.txt")
+	dupPath := filepath.Join(sub, "a.txt")
+	if err := os.WriteFile(survivorPath, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dupPath, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dupInfo, err := os.Lstat(dupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	survivor := &File{Path: survivorPath, Size: 1}
+	dup := &File{Path: dupPath, Size: 1, Mtime: dupInfo.ModTime().UnixNano()}
+
+	if err := replaceFile(survivor, dup); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(dupPath)
+	if err != nil {
+		t.Fatalf("replaced symlink doesn't resolve: %v", err)
+	}
+	if string(content) != "x" {
+		t.Errorf("resolved content = %q, want %q", content, "x")
+	}
+}
+
+// TestReplaceFileRefusesPreExistingHardlink guards the same-inode check
+// that stops replaceFile from "linking" two paths that already share an
+// inode.
+func TestReplaceFileRefusesPreExistingHardlink(t *testing.T) {
+	resetActionState(t)
+	actionMode = actionHardlink
+
+	root := t.TempDir()
+	a := filepath.Join(root, "a.txt")
+	b := filepath.Join(root, "b.txt")
+	if err := os.WriteFile(a, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(a, b); err != nil {
+		t.Fatal(err)
+	}
+	infoA, err := os.Lstat(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, ino := statDevIno(infoA)
+
+	survivor := &File{Path: a, Size: 1, Dev: dev, Ino: ino}
+	dup := &File{Path: b, Size: 1, Dev: dev, Ino: ino}
+
+	if err := replaceFile(survivor, dup); err == nil {
+		t.Error("replaceFile should refuse two paths that already share an inode")
+	}
+}
+
+// TestReplaceFileRefusesCrossFilesystemHardlink guards the check that
+// stops hardlink/reflink from crossing filesystems - it only means
+// anything when Dev is actually populated (e.g. from a live scan or,
+// since chunk0-1's fix, a loaded index; a zero Dev on both sides would
+// make the check pass unconditionally).
+func TestReplaceFileRefusesCrossFilesystemHardlink(t *testing.T) {
+	resetActionState(t)
+	actionMode = actionHardlink
+
+	root := t.TempDir()
+	a := filepath.Join(root, "a.txt")
+	b := filepath.Join(root, "b.txt")
+	if err := os.WriteFile(a, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(b, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	infoB, err := os.Lstat(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	survivor := &File{Path: a, Size: 1, Dev: 1, Ino: 10}
+	dup := &File{Path: b, Size: 1, Dev: 2, Ino: 20, Mtime: infoB.ModTime().UnixNano()}
+
+	if err := replaceFile(survivor, dup); err == nil {
+		t.Error("replaceFile should refuse to hardlink across filesystems")
+	}
+}
+
+// TestReflinkPreservesPermissions guards against the clone destination
+// always landing at a hardcoded 0644, which would silently widen (or
+// narrow) the permissions of the duplicate it's replacing.
+func TestReflinkPreservesPermissions(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "src.txt")
+	dst := filepath.Join(root, "dst.txt")
+	if err := os.WriteFile(src, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reflink(src, dst, 0600); err != nil {
+		if errors.Is(err, unix.ENOTTY) || errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EXDEV) {
+			t.Skipf("filesystem doesn't support reflink: %v", err)
+		}
+		t.Fatal(err)
+	}
+
+	info, err := os.Lstat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("reflinked file perm = %o, want %o", info.Mode().Perm(), 0600)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// cacheKey identifies a file well enough to know a previously computed
+// SlowHash is still valid without re-reading it.
+type cacheKey struct {
+	dev   uint64
+	ino   uint64
+	size  int64
+	mtime int64
+}
+
+// hashCache is a sidecar file of {path, size, mtime, inode, slowHash}
+// records. It's looked up both by the exact path SlowHash was computed for
+// and, as a fallback, by cacheKey alone, so a file that was renamed but not
+// otherwise touched is still recognized.
+type hashCache struct {
+	byKey  map[cacheKey]string
+	byPath map[string]cacheKey
+	dirty  bool
+}
+
+func newHashCache() *hashCache {
+	return &hashCache{
+		byKey:  make(map[cacheKey]string),
+		byPath: make(map[string]cacheKey),
+	}
+}
+
+// loadHashCache reads name if it exists, or returns an empty cache if it
+// doesn't - a missing cache file just means a cold start, not an error.
+// The cache records which Hasher wrote it; a mismatch against the active
+// slowHasher is rejected rather than silently misreading hash lengths.
+func loadHashCache(name string) (*hashCache, error) {
+	c := newHashCache()
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	algorithm, err := readCacheHeader(r)
+	if err != nil {
+		if err == io.EOF {
+			return c, nil
+		}
+		return nil, err
+	}
+	if algorithm != slowHasher.Name() {
+		return nil, fmt.Errorf("cache %s was written with -hash=%s, not %s", name, algorithm, slowHasher.Name())
+	}
+
+	for {
+		absPath, key, hash, err := readCacheRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.byKey[key] = hash
+		c.byPath[absPath] = key
+	}
+	return c, nil
+}
+
+func (c *hashCache) save(name string) error {
+	if !c.dirty {
+		return nil
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	if err := writeCacheHeader(w, slowHasher.Name()); err != nil {
+		return err
+	}
+	for absPath, key := range c.byPath {
+		if err := writeCacheRecord(w, absPath, key, c.byKey[key]); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func writeCacheHeader(w io.Writer, algorithm string) error {
+	if err := binary.Write(w, binary.BigEndian, uint16(len(algorithm))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, algorithm)
+	return err
+}
+
+func readCacheHeader(r io.Reader) (string, error) {
+	var nameLen uint16
+	if err := binary.Read(r, binary.BigEndian, &nameLen); err != nil {
+		return "", err
+	}
+	nameBytes := make([]byte, nameLen)
+	if _, err := io.ReadFull(r, nameBytes); err != nil {
+		return "", err
+	}
+	return string(nameBytes), nil
+}
+
+func (c *hashCache) lookup(path string, key cacheKey) (string, bool) {
+	if k, ok := c.byPath[path]; ok && k == key {
+		return c.byKey[k], true
+	}
+	hash, ok := c.byKey[key]
+	return hash, ok
+}
+
+func (c *hashCache) store(path string, key cacheKey, hash string) {
+	c.byKey[key] = hash
+	c.byPath[path] = key
+	c.dirty = true
+}
+
+// statDevIno extracts the device and inode same relies on to key the hash
+// cache. It returns zero values on platforms without a syscall.Stat_t.
+func statDevIno(fileinfo os.FileInfo) (dev uint64, ino uint64) {
+	stat, ok := fileinfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	return uint64(stat.Dev), stat.Ino
+}
+
+func writeCacheRecord(w io.Writer, path string, key cacheKey, hash string) error {
+	if err := binary.Write(w, binary.BigEndian, uint16(len(path))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, path); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, key.dev); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, key.ino); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, key.size); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, key.mtime); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, hash)
+	return err
+}
+
+func readCacheRecord(r io.Reader) (string, cacheKey, string, error) {
+	var nameLen uint16
+	if err := binary.Read(r, binary.BigEndian, &nameLen); err != nil {
+		return "", cacheKey{}, "", err
+	}
+	nameBytes := make([]byte, nameLen)
+	if _, err := io.ReadFull(r, nameBytes); err != nil {
+		return "", cacheKey{}, "", err
+	}
+	var key cacheKey
+	if err := binary.Read(r, binary.BigEndian, &key.dev); err != nil {
+		return "", cacheKey{}, "", err
+	}
+	if err := binary.Read(r, binary.BigEndian, &key.ino); err != nil {
+		return "", cacheKey{}, "", err
+	}
+	if err := binary.Read(r, binary.BigEndian, &key.size); err != nil {
+		return "", cacheKey{}, "", err
+	}
+	if err := binary.Read(r, binary.BigEndian, &key.mtime); err != nil {
+		return "", cacheKey{}, "", err
+	}
+	hash := make([]byte, slowHashSize())
+	if _, err := io.ReadFull(r, hash); err != nil {
+		return "", cacheKey{}, "", err
+	}
+	return string(nameBytes), key, string(hash), nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestHashCacheRoundTrip covers a save/load cycle: a hash stored under one
+// cache instance should be found by both exact path and bare key lookup
+// from a freshly loaded one.
+func TestHashCacheRoundTrip(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "cache.db")
+	key := cacheKey{dev: 1, ino: 2, size: 3, mtime: 4}
+	hash := string(make([]byte, slowHashSize()))
+
+	c := newHashCache()
+	c.store("/some/path", key, hash)
+	if err := c.save(name); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadHashCache(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := loaded.lookup("/some/path", key); !ok || got != hash {
+		t.Errorf("lookup by path = (%q, %v), want (%q, true)", got, ok, hash)
+	}
+	if got, ok := loaded.lookup("/some/other/path", key); !ok || got != hash {
+		t.Errorf("lookup by bare key (renamed file) = (%q, %v), want (%q, true)", got, ok, hash)
+	}
+}
+
+// TestHashCacheRejectsAlgorithmMismatch guards the check that stops a cache
+// written with one slow-hash algorithm from being silently misread with
+// another, which would misinterpret hash lengths.
+func TestHashCacheRejectsAlgorithmMismatch(t *testing.T) {
+	savedHasher := slowHasher
+	defer func() { slowHasher = savedHasher }()
+
+	name := filepath.Join(t.TempDir(), "cache.db")
+	slowHasher = mustHasher(t, "sha256")
+	c := newHashCache()
+	c.store("/some/path", cacheKey{size: 1}, string(make([]byte, slowHashSize())))
+	if err := c.save(name); err != nil {
+		t.Fatal(err)
+	}
+
+	slowHasher = mustHasher(t, "sha512")
+	if _, err := loadHashCache(name); err == nil {
+		t.Error("loadHashCache should reject a cache written with a different algorithm")
+	}
+}
+
+func mustHasher(t *testing.T, name string) Hasher {
+	t.Helper()
+	h, err := lookupHasher(name, defaultShakeSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// TestLookupHasherShake256SizeConfigurable guards -hash-size actually
+// changing shake256's digest length (and thus the bytes SlowHash produces),
+// and the resulting Hasher's Name reflecting that length so an index or
+// cache can't silently mix output sizes.
+func TestLookupHasherShake256SizeConfigurable(t *testing.T) {
+	h16, err := lookupHasher("shake256", 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h64, err := lookupHasher("shake256", 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h16.Size() != 16 {
+		t.Errorf("Size() = %d, want 16", h16.Size())
+	}
+	if h64.Size() != 64 {
+		t.Errorf("Size() = %d, want 64", h64.Size())
+	}
+	if h16.Name() == h64.Name() {
+		t.Errorf("Name() should differ between output sizes, both gave %q", h16.Name())
+	}
+	if n := len(h16.New().Sum(nil)); n != 16 {
+		t.Errorf("Sum length = %d, want 16", n)
+	}
+	if n := len(h64.New().Sum(nil)); n != 64 {
+		t.Errorf("Sum length = %d, want 64", n)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+)
+
+// cmdDiff implements `same diff <dirA> <dirB>`. It walks both trees in
+// lockstep using the same Merkle hash machinery analyze uses for
+// duplicate detection: whenever two directories' SlowHashes match, the
+// whole subtree is identical and diff prunes it without descending.
+// Otherwise it classifies each child as added, removed, modified, or
+// renamed (same content hash under a different name), and recurses into
+// child directories that still differ.
+//
+// Output is one line per entry, in a stable machine-parseable format:
+//
+//	= path		identical
+//	~ path		modified (same name, different content)
+//	+ path		added
+//	- path		removed
+//	R old -> new	renamed (same content, different name)
+//
+// Directory paths carry a trailing slash.
+func cmdDiff(args []string) {
+	fs := flag.NewFlagSet("same diff", flag.ExitOnError)
+	hashName := fs.String("hash", slowHasher.Name(), "slow-hash algorithm: sha512, sha256, sha3-256, shake256 or blake3")
+	hashSize := fs.Int("hash-size", defaultShakeSize, "output length in bytes for shake256; ignored by fixed-length algorithms")
+	sameDeviceFlag := fs.Bool("same-device", false, "don't descend into directories on a different filesystem than the scanned root")
+	fs.Parse(args)
+	rest := fs.Args()
+	if len(rest) != 2 {
+		fmt.Println("Usage: same diff <dirA> <dirB>")
+		return
+	}
+	h, err := lookupHasher(*hashName, *hashSize)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return
+	}
+	slowHasher = h
+	sameDevice = *sameDeviceFlag
+
+	dirA := path.Clean(rest[0])
+	dirB := path.Clean(rest[1])
+	infoA, err := os.Lstat(dirA)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return
+	}
+	scanRootDev, _ = statDevIno(infoA)
+	rootA := handle(dirA, infoA, 1)
+	infoB, err := os.Lstat(dirB)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return
+	}
+	scanRootDev, _ = statDevIno(infoB)
+	rootB := handle(dirB, infoB, 2)
+
+	hashA, errA := rootA.SlowHash()
+	hashB, errB := rootB.SlowHash()
+	if errA == nil && errB == nil && hashA == hashB {
+		fmt.Println("= .")
+		return
+	}
+	diffChildren("", rootA, rootB)
+}
+
+// displayPath is p with a trailing slash if file is a directory, matching
+// the index format's Size == -1 convention for directories.
+func displayPath(file *File, p string) string {
+	if file.Size < 0 {
+		return p + "/"
+	}
+	return p
+}
+
+// diffChildren compares the children of two directories already known to
+// differ, printing one line per child and recursing into subdirectories
+// that still differ.
+func diffChildren(prefix string, a, b *File) {
+	aByName := make(map[string]*File, len(a.Children))
+	for _, child := range a.Children {
+		aByName[child.Filename] = child
+	}
+	bByName := make(map[string]*File, len(b.Children))
+	for _, child := range b.Children {
+		bByName[child.Filename] = child
+	}
+
+	names := make([]string, 0, len(aByName))
+	for name := range aByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var removed, added []*File
+	for _, name := range names {
+		childA := aByName[name]
+		childB, ok := bByName[name]
+		if !ok {
+			removed = append(removed, childA)
+			continue
+		}
+		delete(bByName, name)
+		p := path.Join(prefix, name)
+		if kindOf(childA) != kindOf(childB) {
+			// Same name, different kind: treat as a removal of the old
+			// entry and an addition of the new one.
+			removed = append(removed, childA)
+			added = append(added, childB)
+			continue
+		}
+		hashA, errA := childA.SlowHash()
+		hashB, errB := childB.SlowHash()
+		if errA == nil && errB == nil && hashA == hashB {
+			fmt.Printf("= %s\n", displayPath(childA, p))
+			continue
+		}
+		if kindOf(childA) == kindDir {
+			diffChildren(p, childA, childB)
+			continue
+		}
+		fmt.Printf("~ %s\n", p)
+	}
+	for name, child := range bByName {
+		_ = name
+		added = append(added, child)
+	}
+	sort.Slice(added, func(i, j int) bool { return added[i].Filename < added[j].Filename })
+
+	// Index removed entries by content hash so a rename shows up as one
+	// "R old -> new" line instead of a "-" and a "+".
+	removedByHash := make(map[string][]*File)
+	for _, file := range removed {
+		hash, err := file.SlowHash()
+		if err != nil {
+			continue
+		}
+		removedByHash[hash] = append(removedByHash[hash], file)
+	}
+	matched := make(map[*File]bool, len(removed))
+
+	for _, file := range added {
+		hash, err := file.SlowHash()
+		if err == nil {
+			if candidates := removedByHash[hash]; len(candidates) > 0 {
+				old := candidates[0]
+				removedByHash[hash] = candidates[1:]
+				matched[old] = true
+				oldPath := path.Join(prefix, old.Filename)
+				newPath := path.Join(prefix, file.Filename)
+				fmt.Printf("R %s -> %s\n", displayPath(old, oldPath), displayPath(file, newPath))
+				continue
+			}
+		}
+		fmt.Printf("+ %s\n", displayPath(file, path.Join(prefix, file.Filename)))
+	}
+
+	sort.Slice(removed, func(i, j int) bool { return removed[i].Filename < removed[j].Filename })
+	for _, file := range removed {
+		if matched[file] {
+			continue
+		}
+		fmt.Printf("- %s\n", displayPath(file, path.Join(prefix, file.Filename)))
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// captureStdout runs fn with os.Stdout redirected to a pipe and returns
+// whatever it wrote.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = saved }()
+
+	fn()
+
+	w.Close()
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+// TestCmdDiffRenameAndModify covers the main diff outcomes end to end:
+// an untouched file is pruned ("="), a renamed file is matched by content
+// ("R"), and a changed file is reported as modified ("~").
+func TestCmdDiffRenameAndModify(t *testing.T) {
+	resetScanState(t)
+	dirA := t.TempDir()
+	dirB := t.TempDir()
+
+	write := func(dir, name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(dirA, "same.txt", "unchanged")
+	write(dirA, "old.txt", "renamed-content")
+	write(dirA, "changed.txt", "before")
+
+	write(dirB, "same.txt", "unchanged")
+	write(dirB, "new.txt", "renamed-content")
+	write(dirB, "changed.txt", "after")
+
+	out := captureStdout(t, func() {
+		cmdDiff([]string{dirA, dirB})
+	})
+
+	lines := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		lines[line] = true
+	}
+
+	want := []string{
+		"= same.txt",
+		"R old.txt -> new.txt",
+		"~ changed.txt",
+	}
+	sort.Strings(want)
+	for _, w := range want {
+		if !lines[w] {
+			t.Errorf("diff output missing %q, got %v", w, out)
+		}
+	}
+}
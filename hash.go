@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+
+	"github.com/zeebo/blake3"
+	"golang.org/x/crypto/sha3"
+)
+
+// Hasher is a pluggable SlowHash algorithm. New returns a fresh hash.Hash,
+// Name identifies the algorithm - and is what a persistent index records,
+// so mixing algorithms within one index can be rejected explicitly - and
+// Size is the number of bytes New's Sum produces.
+type Hasher interface {
+	New() hash.Hash
+	Name() string
+	Size() int
+}
+
+// Domain-separation bytes distinguish a file's content hash, a directory's
+// folded hash, and a symlink's folded target string, so the same algorithm
+// can never confuse one for another.
+const (
+	fileHashDomain    byte = 1
+	dirHashDomain     byte = 2
+	symlinkHashDomain byte = 3
+)
+
+// slowHasher is the algorithm SlowHash uses. Defaults to SHA-512 for
+// backwards compatibility with indexes and caches written before -hash
+// existed.
+var slowHasher Hasher = sha512Hasher{}
+
+// defaultShakeSize is the SHAKE256 output length -hash-size falls back to
+// when the user doesn't care to change it.
+const defaultShakeSize = 32
+
+// hashers builds the Hasher for a -hash flag value. size is the requested
+// -hash-size and only shake256, an extendable-output function, does
+// anything with it; every other algorithm has a fixed digest length and
+// ignores it.
+var hashers = map[string]func(size int) Hasher{
+	"sha512":   func(size int) Hasher { return sha512Hasher{} },
+	"sha256":   func(size int) Hasher { return sha256Hasher{} },
+	"sha3-256": func(size int) Hasher { return sha3_256Hasher{} },
+	"shake256": func(size int) Hasher { return shake256Hasher{size: size} },
+	"blake3":   func(size int) Hasher { return blake3Hasher{} },
+}
+
+// lookupHasher resolves a -hash flag value (and, for shake256, a -hash-size
+// output length) to a Hasher.
+func lookupHasher(name string, size int) (Hasher, error) {
+	f, ok := hashers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash algorithm %q", name)
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("-hash-size must be positive, got %d", size)
+	}
+	return f(size), nil
+}
+
+type sha512Hasher struct{}
+
+func (sha512Hasher) New() hash.Hash { return sha512.New() }
+func (sha512Hasher) Name() string   { return "sha512" }
+func (sha512Hasher) Size() int      { return sha512.Size }
+
+type sha256Hasher struct{}
+
+func (sha256Hasher) New() hash.Hash { return sha256.New() }
+func (sha256Hasher) Name() string   { return "sha256" }
+func (sha256Hasher) Size() int      { return sha256.Size }
+
+type sha3_256Hasher struct{}
+
+func (sha3_256Hasher) New() hash.Hash { return sha3.New256() }
+func (sha3_256Hasher) Name() string   { return "sha3-256" }
+func (sha3_256Hasher) Size() int      { return 32 }
+
+// shake256Hasher adapts SHAKE256, an extendable-output function, to
+// hash.Hash at a fixed, configurable output length.
+type shake256Hasher struct {
+	size int
+}
+
+func (h shake256Hasher) New() hash.Hash {
+	return &shakeHash{ShakeHash: sha3.NewShake256(), size: h.size}
+}
+
+// Name encodes the output length so an index or cache written with one
+// -hash-size is never silently misread with another.
+func (h shake256Hasher) Name() string { return fmt.Sprintf("shake256-%d", h.size) }
+func (h shake256Hasher) Size() int    { return h.size }
+
+// shakeHash overrides Sum/Size on sha3.ShakeHash so it can stand in for a
+// fixed-size hash.Hash: Sum reads size bytes from a clone, leaving the
+// original state (and thus further Writes) untouched.
+type shakeHash struct {
+	sha3.ShakeHash
+	size int
+}
+
+func (s *shakeHash) Sum(b []byte) []byte {
+	out := make([]byte, s.size)
+	s.ShakeHash.Clone().Read(out)
+	return append(b, out...)
+}
+
+func (s *shakeHash) Size() int { return s.size }
+
+type blake3Hasher struct{}
+
+func (blake3Hasher) New() hash.Hash { return blake3.New() }
+func (blake3Hasher) Name() string   { return "blake3" }
+func (blake3Hasher) Size() int      { return 32 }
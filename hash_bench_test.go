@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// buildSyntheticTree writes a directory tree of width*depth duplicate-heavy
+// files under a temp dir, for benchmarking the hashing pipeline without
+// depending on a real dataset.
+func buildSyntheticTree(b *testing.B, width, depth int) string {
+	b.Helper()
+	root := b.TempDir()
+	var write func(dir string, depth int)
+	write = func(dir string, depth int) {
+		for i := 0; i < width; i++ {
+			if depth == 0 {
+				name := filepath.Join(dir, fmt.Sprintf("file%d.bin", i))
+				// Every other file repeats the same content, so FastHash
+				// collisions - and SlowHash work - are representative.
+				content := fmt.Sprintf("payload-%d", i%2)
+				if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+					b.Fatal(err)
+				}
+				continue
+			}
+			sub := filepath.Join(dir, fmt.Sprintf("dir%d", i))
+			if err := os.Mkdir(sub, 0755); err != nil {
+				b.Fatal(err)
+			}
+			write(sub, depth-1)
+		}
+	}
+	write(root, depth)
+	return root
+}
+
+func BenchmarkAnalyzeParallel(b *testing.B) {
+	for _, j := range []int{1, 4, runtime.NumCPU()} {
+		b.Run(fmt.Sprintf("j=%d", j), func(b *testing.B) {
+			root := buildSyntheticTree(b, 8, 3)
+			for i := 0; i < b.N; i++ {
+				levels = nil
+				hashWorkers = j
+				fileinfo, err := os.Stat(root)
+				if err != nil {
+					b.Fatal(err)
+				}
+				handle(root, fileinfo, 1)
+				analyze(root+"/", false)
+			}
+		})
+	}
+}
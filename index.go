@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+)
+
+// On-disk index format.
+//
+// A database starts with an 8-byte magic string, a length-prefixed hash
+// algorithm name (see Hasher), and a 16-bit BE count of root entries. The
+// algorithm name is checked against the active slowHasher on load and
+// rejected on mismatch, since SlowHash bytes from two different algorithms
+// can't be compared or sized correctly. Each root, and every file or
+// directory below it, is then emitted depth-first as a sequence of
+// records, each starting with a 1-byte entity type so a reader never has
+// to guess what follows:
+//
+//	1 byte entity type (entryFile, entryDir, entrySymlink or entryDirEnd)
+//
+// For entryFile, entryDir and entrySymlink, the type is followed by:
+//
+//	uint16 BE name length
+//	name bytes
+//	int64 BE size (-1 for directories)
+//	int64 BE mtime, unix nanoseconds
+//	uint64 BE dev
+//	uint64 BE ino
+//
+// dev/ino are whatever statDevIno saw when the entry was scanned (0, 0 on
+// a platform without syscall.Stat_t) - carrying them through the index is
+// what lets replaceFile and reportHardlinks recognize files that already
+// share an inode, and the hash cache key a file by more than size/mtime
+// alone, even when they were loaded from a database instead of a live
+// scan. SAMEIDX1, the format this replaced, didn't carry dev/ino at all;
+// readIndexHeader rejects it by magic rather than guessing zeros for a
+// field that was never written.
+//
+// entrySymlink additionally carries its link target right after that:
+//
+//	uint16 BE target length
+//	target bytes
+//
+// entryFile and entrySymlink then carry their hash immediately:
+//
+//	16 bytes FastHash
+//	1 byte: 1 if a SlowHash was already known, 0 otherwise
+//	if 1: the SlowHash bytes
+//
+// entryDir is instead followed by its children, and then by an entryDirEnd
+// record carrying the directory's own hash in the same layout:
+//
+//	1 byte entryDirEnd
+//	16 bytes FastHash
+//	1 byte: 1 if a SlowHash was already known, 0 otherwise
+//	if 1: the SlowHash bytes
+//
+// Keeping the close record separate from the open record lets a writer
+// stream a tree out before the directory's hash - which depends on all of
+// its children - is known, and lets a reader rebuild parent/child links
+// without seeking.
+
+const indexMagic = "SAMEIDX2"
+
+type entryType byte
+
+const (
+	entryFile entryType = iota
+	entryDir
+	entrySymlink
+	entryDirEnd
+)
+
+func cmdIndex(args []string) {
+	fs := flag.NewFlagSet("same index", flag.ExitOnError)
+	hashName := fs.String("hash", slowHasher.Name(), "slow-hash algorithm to record in the index")
+	hashSize := fs.Int("hash-size", defaultShakeSize, "output length in bytes for shake256; ignored by fixed-length algorithms")
+	sameDeviceFlag := fs.Bool("same-device", false, "don't descend into directories on a different filesystem than the scanned root")
+	fs.Parse(args)
+	rest := fs.Args()
+	if len(rest) < 2 {
+		fmt.Println("Usage: same index <db> <dir>...")
+		return
+	}
+	db, dirnames := rest[0], rest[1:]
+	h, err := lookupHasher(*hashName, *hashSize)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return
+	}
+	slowHasher = h
+	sameDevice = *sameDeviceFlag
+
+	roots := make([]*File, 0, len(dirnames))
+	for i, arg := range dirnames {
+		dirname := path.Clean(arg)
+		fileinfo, err := os.Lstat(dirname)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return
+		}
+		scanRootDev, _ = statDevIno(fileinfo)
+		roots = append(roots, handle(dirname, fileinfo, i+1))
+	}
+
+	if err := saveIndex(db, roots); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+	}
+}
+
+func cmdAnalyze(args []string) {
+	fs := flag.NewFlagSet("same analyze", flag.ExitOnError)
+	cache := fs.String("cache", "", "slow-hash cache file, shared across runs")
+	j := fs.Int("j", runtime.NumCPU(), "number of files to hash concurrently")
+	hashName := fs.String("hash", slowHasher.Name(), "slow-hash algorithm; must match the one the index was written with")
+	hashSize := fs.Int("hash-size", defaultShakeSize, "output length in bytes for shake256; must match the one the index was written with")
+	action := fs.String("action", string(actionPrint), "what to do with duplicates: print, hardlink, reflink, symlink or delete")
+	keep := fs.String("keep", string(keepFirst), "which group member to keep: first, shortest-path, oldest or newest")
+	dryRunFlag := fs.Bool("dry-run", false, "run every -action check but don't touch the filesystem")
+	report := fs.String("report", "", "write a JSON summary of what -action did to this file (- for stdout)")
+	fs.Parse(args)
+	rest := fs.Args()
+	if len(rest) < 1 {
+		fmt.Println("Usage: same analyze <db>")
+		return
+	}
+	hashWorkers = *j
+	h, err := lookupHasher(*hashName, *hashSize)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return
+	}
+	slowHasher = h
+	a, err := lookupActionMode(*action)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return
+	}
+	actionMode = a
+	k, err := lookupKeepPolicy(*keep)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return
+	}
+	keepPolicy = k
+	dryRun = *dryRunFlag
+	if *report != "" {
+		defer func() {
+			if err := writeReport(*report); err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+			}
+		}()
+	}
+
+	if *cache != "" {
+		c, err := loadHashCache(*cache)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return
+		}
+		slowCache = c
+		defer func() {
+			if err := slowCache.save(*cache); err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+			}
+		}()
+	}
+
+	roots, err := loadIndex(rest[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return
+	}
+
+	if len(roots) == 1 {
+		analyze(roots[0].Path, false)
+	} else {
+		analyze("", true)
+	}
+
+	// Persist whatever SlowHashes this run computed, so a later analyze of
+	// the same db can reuse them instead of re-reading file content.
+	if err := saveIndex(rest[0], roots); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+	}
+}
+
+// loadIndex reads every root tree stored in db, reinserting each File into
+// levels as it goes so analyze and update never have to re-stat or
+// re-hash anything that hasn't changed.
+func loadIndex(db string) ([]*File, error) {
+	f, err := os.Open(db)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	algorithm, numRoots, err := readIndexHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if algorithm != slowHasher.Name() {
+		return nil, fmt.Errorf("index %s was written with -hash=%s, not %s", db, algorithm, slowHasher.Name())
+	}
+	roots := make([]*File, 0, numRoots)
+	for i := 0; i < numRoots; i++ {
+		root, err := readEntry(r, i+1, "")
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, root)
+	}
+	return roots, nil
+}
+
+// saveIndex writes roots to db in full, replacing any previous contents.
+func saveIndex(db string, roots []*File) error {
+	f, err := os.Create(db)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	if err := writeIndexHeader(w, slowHasher.Name(), len(roots)); err != nil {
+		return err
+	}
+	for _, root := range roots {
+		// The root's own name must be its full path: readEntry rebuilds
+		// every descendant's path by joining onto it.
+		name := strings.TrimSuffix(root.Path, "/")
+		if err := writeEntry(w, root, name); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func writeIndexHeader(w io.Writer, algorithm string, roots int) error {
+	if _, err := io.WriteString(w, indexMagic); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint16(len(algorithm))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, algorithm); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, uint16(roots))
+}
+
+func readIndexHeader(r io.Reader) (string, int, error) {
+	magic := make([]byte, len(indexMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return "", 0, err
+	}
+	if string(magic) != indexMagic {
+		return "", 0, fmt.Errorf("index: bad magic %q", magic)
+	}
+	var nameLen uint16
+	if err := binary.Read(r, binary.BigEndian, &nameLen); err != nil {
+		return "", 0, err
+	}
+	nameBytes := make([]byte, nameLen)
+	if _, err := io.ReadFull(r, nameBytes); err != nil {
+		return "", 0, err
+	}
+	var roots uint16
+	if err := binary.Read(r, binary.BigEndian, &roots); err != nil {
+		return "", 0, err
+	}
+	return string(nameBytes), int(roots), nil
+}
+
+// writeEntry serializes file, and its children if it is a directory,
+// depth-first. name is the string a reader should join onto its parent to
+// reconstruct file.Path - the root of a tree is written with its full path,
+// every other entry with its bare filename.
+func writeEntry(w io.Writer, file *File, name string) error {
+	kind := entryFile
+	switch {
+	case file.Size < 0:
+		kind = entryDir
+	case file.LinkTarget != "":
+		kind = entrySymlink
+	}
+	if err := writeHeader(w, kind, name, file.Size, file.Mtime, file.Dev, file.Ino); err != nil {
+		return err
+	}
+	if kind == entrySymlink {
+		if err := writeLinkTarget(w, file.LinkTarget); err != nil {
+			return err
+		}
+		return writeHash(w, file)
+	}
+	if kind == entryFile {
+		return writeHash(w, file)
+	}
+	for _, child := range file.Children {
+		if err := writeEntry(w, child, child.Filename); err != nil {
+			return err
+		}
+	}
+	if err := binary.Write(w, binary.BigEndian, entryDirEnd); err != nil {
+		return err
+	}
+	return writeHash(w, file)
+}
+
+func writeHeader(w io.Writer, kind entryType, name string, size int64, mtime int64, dev uint64, ino uint64) error {
+	if err := binary.Write(w, binary.BigEndian, kind); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint16(len(name))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, name); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, size); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, mtime); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, dev); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, ino)
+}
+
+func writeLinkTarget(w io.Writer, target string) error {
+	if err := binary.Write(w, binary.BigEndian, uint16(len(target))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, target)
+	return err
+}
+
+func readLinkTarget(r io.Reader) (string, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return "", err
+	}
+	target := make([]byte, n)
+	if _, err := io.ReadFull(r, target); err != nil {
+		return "", err
+	}
+	return string(target), nil
+}
+
+func writeHash(w io.Writer, file *File) error {
+	fastHash := file.FastHash()
+	if _, err := io.WriteString(w, fastHash); err != nil {
+		return err
+	}
+	if file.slowHash == "" {
+		return binary.Write(w, binary.BigEndian, byte(0))
+	}
+	if err := binary.Write(w, binary.BigEndian, byte(1)); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, file.slowHash)
+	return err
+}
+
+// readEntry reconstructs the File rooted at the next record in r, inserting
+// every descendant into levels along the way so analyze never has to
+// re-stat or re-hash anything. parentPath is the full path of the entry's
+// parent directory ("" for a root, whose own name is already the full
+// path) - it's threaded down through the recursion rather than joined on
+// after the fact, so every descendant's Path ends up relative to the root
+// regardless of how deep it is.
+func readEntry(r *bufio.Reader, group int, parentPath string) (*File, error) {
+	kind, err := peekEntryType(r)
+	if err != nil {
+		return nil, err
+	}
+	if kind != entryDir {
+		name, size, mtime, dev, ino, err := readHeader(r)
+		if err != nil {
+			return nil, err
+		}
+		file := &File{
+			Lvl:      0,
+			Path:     path.Join(parentPath, name),
+			Filename: name,
+			Size:     size,
+			Mtime:    mtime,
+			Dev:      dev,
+			Ino:      ino,
+			Group:    group,
+		}
+		if kind == entrySymlink {
+			target, err := readLinkTarget(r)
+			if err != nil {
+				return nil, err
+			}
+			file.LinkTarget = target
+		}
+		if err := readHash(r, file); err != nil {
+			return nil, err
+		}
+		insertFile(file)
+		return file, nil
+	}
+
+	name, _, mtime, dev, ino, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	fullPath := path.Join(parentPath, name)
+	var children []*File
+	maxlvl := 1
+	for {
+		childType, err := peekEntryType(r)
+		if err != nil {
+			return nil, err
+		}
+		if childType == entryDirEnd {
+			break
+		}
+		child, err := readEntry(r, group, fullPath)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+		if child.Lvl+1 > maxlvl {
+			maxlvl = child.Lvl + 1
+		}
+	}
+	// Consume the entryDirEnd marker.
+	var end entryType
+	if err := binary.Read(r, binary.BigEndian, &end); err != nil {
+		return nil, err
+	}
+	file := &File{
+		Lvl:      maxlvl,
+		Path:     fullPath + "/",
+		Filename: name,
+		Children: children,
+		Size:     -1,
+		Mtime:    mtime,
+		Dev:      dev,
+		Ino:      ino,
+		Group:    group,
+	}
+	for _, child := range children {
+		child.parent = file
+	}
+	if err := readHash(r, file); err != nil {
+		return nil, err
+	}
+	insertFile(file)
+	return file, nil
+}
+
+// readHeader reads the name/size/mtime/dev/ino fields of a record whose
+// type byte has already been consumed by peekEntryType.
+func readHeader(r *bufio.Reader) (name string, size int64, mtime int64, dev uint64, ino uint64, err error) {
+	var kind entryType
+	if err = binary.Read(r, binary.BigEndian, &kind); err != nil {
+		return
+	}
+	var nameLen uint16
+	if err = binary.Read(r, binary.BigEndian, &nameLen); err != nil {
+		return
+	}
+	nameBytes := make([]byte, nameLen)
+	if _, err = io.ReadFull(r, nameBytes); err != nil {
+		return
+	}
+	name = string(nameBytes)
+	if err = binary.Read(r, binary.BigEndian, &size); err != nil {
+		return
+	}
+	if err = binary.Read(r, binary.BigEndian, &mtime); err != nil {
+		return
+	}
+	if err = binary.Read(r, binary.BigEndian, &dev); err != nil {
+		return
+	}
+	err = binary.Read(r, binary.BigEndian, &ino)
+	return
+}
+
+func readHash(r io.Reader, file *File) error {
+	fastHash := make([]byte, 16)
+	if _, err := io.ReadFull(r, fastHash); err != nil {
+		return err
+	}
+	file.fastHash = string(fastHash)
+	var present byte
+	if err := binary.Read(r, binary.BigEndian, &present); err != nil {
+		return err
+	}
+	if present == 0 {
+		return nil
+	}
+	slowHash := make([]byte, slowHashSize())
+	if _, err := io.ReadFull(r, slowHash); err != nil {
+		return err
+	}
+	file.slowHash = string(slowHash)
+	return nil
+}
+
+// peekEntryType looks at the type byte of the next record without
+// consuming it, so readEntry can tell a child record from the entryDirEnd
+// marker that closes the current directory.
+func peekEntryType(r *bufio.Reader) (entryType, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	return entryType(b[0]), nil
+}
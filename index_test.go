@@ -0,0 +1,225 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// resetScanState clears the package-level scan state handle/analyze/loadIndex
+// mutate, so test cases don't leak into each other.
+func resetScanState(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		levels = nil
+		slowCache = nil
+		inodeIndex = make(map[[2]uint64]*File)
+		sameDevice = false
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// TestIndexRoundTripNestedPaths guards against readEntry rebuilding a
+// descendant's Path against only its immediate parent's bare name instead
+// of the parent's full reconstructed path - a bug that only showed up one
+// level below the root.
+func TestIndexRoundTripNestedPaths(t *testing.T) {
+	resetScanState(t)
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "subdir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "subdir", "a.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "b.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fileinfo, err := os.Lstat(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanRootDev, _ = statDevIno(fileinfo)
+	tree := handle(root, fileinfo, 1)
+
+	db := filepath.Join(t.TempDir(), "db")
+	if err := saveIndex(db, []*File{tree}); err != nil {
+		t.Fatal(err)
+	}
+
+	roots, err := loadIndex(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 1 {
+		t.Fatalf("got %d roots, want 1", len(roots))
+	}
+
+	paths := map[string]bool{}
+	var walk func(f *File)
+	walk = func(f *File) {
+		paths[strings.TrimSuffix(f.Path, "/")] = true
+		for _, c := range f.Children {
+			walk(c)
+		}
+	}
+	walk(roots[0])
+
+	for _, want := range []string{
+		filepath.Join(root, "subdir", "a.txt"),
+		filepath.Join(root, "subdir"),
+		filepath.Join(root, "b.txt"),
+	} {
+		if !paths[want] {
+			t.Errorf("reconstructed tree missing path %q, got %v", want, paths)
+		}
+	}
+}
+
+// TestIndexPersistsSlowHash guards against an already-known SlowHash being
+// silently recomputed (and therefore requiring the original file to still
+// exist) after a save/load round trip.
+func TestIndexPersistsSlowHash(t *testing.T) {
+	resetScanState(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "f1.txt"), []byte("dup"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fileinfo, err := os.Lstat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanRootDev, _ = statDevIno(fileinfo)
+	tree := handle(dir, fileinfo, 1)
+
+	target := childNamed(tree, "f1.txt")
+	if target == nil {
+		t.Fatal("f1.txt not found in scanned tree")
+	}
+	if _, err := target.SlowHash(); err != nil {
+		t.Fatal(err)
+	}
+
+	db := filepath.Join(t.TempDir(), "db")
+	if err := saveIndex(db, []*File{tree}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "f1.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	resetScanState(t)
+	roots, err := loadIndex(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := childNamed(roots[0], "f1.txt")
+	if loaded == nil {
+		t.Fatal("f1.txt missing after reload")
+	}
+	if _, err := loaded.SlowHash(); err != nil {
+		t.Fatalf("SlowHash should reuse the persisted hash instead of re-reading the deleted file: %v", err)
+	}
+}
+
+// TestIndexRoundTripPreservesDevIno guards against Dev/Ino being dropped on
+// a save/load round trip, which collapsed every reconstructed File to
+// (0, 0) - defeating the hash cache's (dev, ino, size, mtime) fallback key,
+// pre-existing-hardlink detection, and the cross-filesystem refusal in
+// replaceFile all at once.
+func TestIndexRoundTripPreservesDevIno(t *testing.T) {
+	resetScanState(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "f1.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fileinfo, err := os.Lstat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanRootDev, _ = statDevIno(fileinfo)
+	tree := handle(dir, fileinfo, 1)
+	wantDev, wantIno := childNamed(tree, "f1.txt").Dev, childNamed(tree, "f1.txt").Ino
+	if wantIno == 0 {
+		t.Fatal("scanned file has Ino == 0, can't test round trip")
+	}
+
+	db := filepath.Join(t.TempDir(), "db")
+	if err := saveIndex(db, []*File{tree}); err != nil {
+		t.Fatal(err)
+	}
+
+	resetScanState(t)
+	roots, err := loadIndex(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := childNamed(roots[0], "f1.txt")
+	if got.Dev != wantDev || got.Ino != wantIno {
+		t.Errorf("reloaded Dev/Ino = (%d, %d), want (%d, %d)", got.Dev, got.Ino, wantDev, wantIno)
+	}
+}
+
+// TestAnalyzeFromIndexReportsPreExistingHardlinks guards against analyze
+// silently losing pre-existing-hardlink detection when its input comes from
+// a loaded index rather than a live scan - reportHardlinks groups files by
+// (Dev, Ino), which only means anything if loadIndex actually restores those
+// fields.
+func TestAnalyzeFromIndexReportsPreExistingHardlinks(t *testing.T) {
+	resetScanState(t)
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.txt")
+	b := filepath.Join(dir, "b.txt")
+	c := filepath.Join(dir, "c.txt")
+	if err := os.WriteFile(a, []byte("dup"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(a, c); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(b, []byte("dup"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fileinfo, err := os.Lstat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanRootDev, _ = statDevIno(fileinfo)
+	tree := handle(dir, fileinfo, 1)
+
+	db := filepath.Join(t.TempDir(), "db")
+	if err := saveIndex(db, []*File{tree}); err != nil {
+		t.Fatal(err)
+	}
+
+	resetScanState(t)
+	roots, err := loadIndex(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := captureStdout(t, func() {
+		analyze(roots[0].Path, false)
+	})
+	if !strings.Contains(out, "H ") {
+		t.Errorf("analyze output missing a pre-existing-hardlink report, got %q", out)
+	}
+	if !strings.Contains(out, "a.txt = c.txt") && !strings.Contains(out, "c.txt = a.txt") {
+		t.Errorf("analyze output should pair up a.txt and c.txt as hardlinks, got %q", out)
+	}
+}
+
+func childNamed(dir *File, name string) *File {
+	for _, c := range dir.Children {
+		if c.Filename == name {
+			return c
+		}
+	}
+	return nil
+}
@@ -1,14 +1,18 @@
 package main
 
 import (
-	"crypto/sha512"
 	"encoding/binary"
+	"flag"
 	"fmt"
 	"hash/fnv"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 )
 
 func main() {
@@ -16,24 +20,103 @@ func main() {
 		fmt.Println("You must specify at least one directory")
 		return
 	}
-	if len(os.Args) == 2 {
-		dirname := path.Clean(os.Args[1])
-		fileinfo, err := os.Stat(dirname)
+	switch os.Args[1] {
+	case "index":
+		cmdIndex(os.Args[2:])
+	case "analyze":
+		cmdAnalyze(os.Args[2:])
+	case "update":
+		cmdUpdate(os.Args[2:])
+	case "diff":
+		cmdDiff(os.Args[2:])
+	default:
+		cmdScan(os.Args[1:])
+	}
+}
+
+// cmdScan implements the original invocation: `same <dir>...`. It walks the
+// filesystem and runs duplicate detection in a single pass, holding the
+// whole tree in memory.
+func cmdScan(args []string) {
+	fs := flag.NewFlagSet("same", flag.ExitOnError)
+	cache := fs.String("cache", "", "slow-hash cache file, shared across runs")
+	j := fs.Int("j", runtime.NumCPU(), "number of files to hash concurrently")
+	hashName := fs.String("hash", slowHasher.Name(), "slow-hash algorithm: sha512, sha256, sha3-256, shake256 or blake3")
+	hashSize := fs.Int("hash-size", defaultShakeSize, "output length in bytes for shake256; ignored by fixed-length algorithms")
+	action := fs.String("action", string(actionPrint), "what to do with duplicates: print, hardlink, reflink, symlink or delete")
+	keep := fs.String("keep", string(keepFirst), "which group member to keep: first, shortest-path, oldest or newest")
+	dryRunFlag := fs.Bool("dry-run", false, "run every -action check but don't touch the filesystem")
+	report := fs.String("report", "", "write a JSON summary of what -action did to this file (- for stdout)")
+	sameDeviceFlag := fs.Bool("same-device", false, "don't descend into directories on a different filesystem than the scanned root")
+	fs.Parse(args)
+	dirnames := fs.Args()
+	if len(dirnames) == 0 {
+		fmt.Println("You must specify at least one directory")
+		return
+	}
+	hashWorkers = *j
+	sameDevice = *sameDeviceFlag
+	h, err := lookupHasher(*hashName, *hashSize)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return
+	}
+	slowHasher = h
+	a, err := lookupActionMode(*action)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return
+	}
+	actionMode = a
+	k, err := lookupKeepPolicy(*keep)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return
+	}
+	keepPolicy = k
+	dryRun = *dryRunFlag
+	if *report != "" {
+		defer func() {
+			if err := writeReport(*report); err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+			}
+		}()
+	}
+
+	if *cache != "" {
+		c, err := loadHashCache(*cache)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return
+		}
+		slowCache = c
+		defer func() {
+			if err := slowCache.save(*cache); err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+			}
+		}()
+	}
+
+	if len(dirnames) == 1 {
+		dirname := path.Clean(dirnames[0])
+		fileinfo, err := os.Lstat(dirname)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err.Error())
 			return
 		}
+		scanRootDev, _ = statDevIno(fileinfo)
 		handle(dirname, fileinfo, 1)
 		analyze(dirname+"/", false)
 	} else {
-		for i := 1; i < len(os.Args); i++ {
-			dirname := path.Clean(os.Args[i])
-			fileinfo, err := os.Stat(dirname)
+		for i, arg := range dirnames {
+			dirname := path.Clean(arg)
+			fileinfo, err := os.Lstat(dirname)
 			if err != nil {
 				fmt.Fprintln(os.Stderr, err.Error())
 				return
 			}
-			handle(dirname, fileinfo, i)
+			scanRootDev, _ = statDevIno(fileinfo)
+			handle(dirname, fileinfo, i+1)
 		}
 		analyze("", true)
 	}
@@ -41,6 +124,28 @@ func main() {
 
 var levels []map[string]Item
 
+// slowCache, when non-nil, lets SlowHash skip re-reading a file whose
+// (dev, ino, size, mtime) haven't changed since the last run.
+var slowCache *hashCache
+
+// hashWorkers bounds how many files analyze hashes concurrently.
+var hashWorkers = runtime.NumCPU()
+
+// sameDevice, when true, stops handle from descending into a directory
+// whose device differs from scanRootDev - i.e. a mount point.
+var sameDevice bool
+
+// scanRootDev is the device of the root currently being scanned. It's set
+// by each top-level caller right before handle is called on that root, so
+// -same-device compares every descendant against the root it came from
+// rather than its immediate parent.
+var scanRootDev uint64
+
+// inodeIndex canonicalizes regular files by (dev, ino): the first File
+// seen for a given inode is canonical, and every later alias points back
+// to it via hardlinkOf instead of hashing the same bytes again.
+var inodeIndex = make(map[[2]uint64]*File)
+
 type Item struct {
 	Aliases []*File
 }
@@ -50,36 +155,107 @@ type File struct {
 	Path     string
 	Filename string
 	Size     int64
+	Mtime    int64
+	Dev      uint64
+	Ino      uint64
 	Children []*File
 	Group    int
 
+	// LinkTarget is non-empty if this File is a symlink, in which case its
+	// SlowHash folds this string rather than reading Path's contents.
+	LinkTarget string
+
+	parent   *File
+	once     sync.Once
 	slowHash string
 	slowErr  error
 	fastHash string
+	// hardlinkOf, if set, is the canonical File for this one's (dev, ino):
+	// SlowHash delegates to it instead of computing its own.
+	hardlinkOf *File
 }
 
+// SlowHash computes the file's content hash, or for a directory the fold
+// of its children's hashes, on first call. Concurrent callers - including
+// a parent directory folding this file alongside a worker pool hashing it
+// directly - share the same sync.Once, so the hash is computed exactly
+// once no matter how many goroutines ask for it at the same time. A file
+// that's a hardlink alias of one already seen delegates to its canonical
+// File instead, so the two never hash the same bytes twice.
 func (f *File) SlowHash() (string, error) {
-	if f.slowHash == "" && f.slowErr == nil {
-		if f.Size >= 0 {
-			hash, err := hashFile(f.Path)
-			f.slowHash = string(hash)
-			f.slowErr = err
-		} else {
-			h := sha512.New()
-			for _, child := range f.Children {
-				childHash, err := child.SlowHash()
-				if err != nil {
-					return "", err
-				}
-				binary.Write(h, binary.BigEndian, len(child.Filename))
-				h.Write([]byte(child.Filename))
-				h.Write([]byte(childHash))
+	if f.hardlinkOf != nil {
+		return f.hardlinkOf.SlowHash()
+	}
+	f.once.Do(f.computeSlowHash)
+	return f.slowHash, f.slowErr
+}
+
+func (f *File) computeSlowHash() {
+	if f.slowHash != "" {
+		// Already known, e.g. loaded from an index - nothing to recompute.
+		return
+	}
+	if f.LinkTarget != "" {
+		h := slowHasher.New()
+		h.Write([]byte(f.LinkTarget))
+		f.slowHash = string(h.Sum([]byte{symlinkHashDomain}))
+		return
+	}
+
+	if f.Size >= 0 {
+		key := cacheKey{f.Dev, f.Ino, f.Size, f.Mtime}
+		if slowCache != nil {
+			if hash, ok := slowCache.lookup(f.Path, key); ok {
+				f.slowHash = hash
+				return
 			}
-			f.slowHash = string(h.Sum([]byte{2}))
-			f.slowErr = nil
 		}
+		hash, err := hashFile(f.Path)
+		f.slowHash = string(hash)
+		f.slowErr = err
+		if err == nil && slowCache != nil {
+			slowCache.store(f.Path, key, f.slowHash)
+		}
+		return
 	}
-	return f.slowHash, f.slowErr
+
+	h := slowHasher.New()
+	for _, child := range f.Children {
+		childHash, err := child.SlowHash()
+		if err != nil {
+			f.slowErr = err
+			return
+		}
+		binary.Write(h, binary.BigEndian, len(child.Filename))
+		h.Write([]byte(child.Filename))
+		h.Write([]byte(childHash))
+	}
+	f.slowHash = string(h.Sum([]byte{dirHashDomain}))
+}
+
+// computeSlowHashes hashes files using a bounded pool of hashWorkers
+// goroutines. A directory's SlowHash waits on its children's futures
+// rather than recursing synchronously, so this parallelizes regardless of
+// whether files mixes plain files and directories.
+func computeSlowHashes(files []*File) {
+	if hashWorkers <= 1 || len(files) <= 1 {
+		for _, file := range files {
+			file.SlowHash()
+		}
+		return
+	}
+	sem := make(chan struct{}, hashWorkers)
+	var wg sync.WaitGroup
+	for _, file := range files {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(file *File) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			file.SlowHash()
+		}(file)
+	}
+	wg.Wait()
 }
 
 func (f *File) FastHash() string {
@@ -96,8 +272,36 @@ func (f *File) FastHash() string {
 	return f.fastHash
 }
 
+// fileKind distinguishes the three kinds of File node that diff and the
+// index format care about.
+type fileKind byte
+
+const (
+	kindFile fileKind = iota
+	kindDir
+	kindSymlink
+)
+
+func kindOf(f *File) fileKind {
+	switch {
+	case f.Size < 0:
+		return kindDir
+	case f.LinkTarget != "":
+		return kindSymlink
+	default:
+		return kindFile
+	}
+}
+
+// slowHashSize is the length of a SlowHash under the active slowHasher: its
+// digest plus the leading domain-separation byte that keeps file hashes
+// and directory hashes from colliding.
+func slowHashSize() int {
+	return slowHasher.Size() + 1
+}
+
 func hashFile(name string) ([]byte, error) {
-	h := sha512.New()
+	h := slowHasher.New()
 	f, err := os.Open(name)
 	defer f.Close()
 	if err != nil {
@@ -109,32 +313,77 @@ func hashFile(name string) ([]byte, error) {
 		fmt.Fprintln(os.Stderr, err.Error())
 		return nil, err
 	}
-	return h.Sum([]byte{1}), nil
+	return h.Sum([]byte{fileHashDomain}), nil
 }
 
 func handle(name string, fileinfo os.FileInfo, group int) *File {
 	filename := fileinfo.Name()
+	dev, ino := statDevIno(fileinfo)
+
+	if fileinfo.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(name)
+		file := &File{
+			Lvl:        0,
+			Path:       name,
+			Filename:   filename,
+			Size:       fileinfo.Size(),
+			Mtime:      fileinfo.ModTime().UnixNano(),
+			Dev:        dev,
+			Ino:        ino,
+			Group:      group,
+			LinkTarget: target,
+			slowErr:    err,
+		}
+		insertFile(file)
+		return file
+	}
+
 	if fileinfo.IsDir() {
-		lvl, files, err := scan(name, group)
+		var lvl int
+		var files []*File
+		var err error
+		if sameDevice && dev != scanRootDev {
+			lvl = 1
+		} else {
+			lvl, files, err = scan(name, group)
+		}
 		file := &File{
 			Lvl:      lvl,
 			Path:     name + "/",
 			Filename: filename,
 			Children: files,
 			Size:     -1,
+			Mtime:    fileinfo.ModTime().UnixNano(),
+			Dev:      dev,
+			Ino:      ino,
 			slowErr:  err,
 			Group:    group,
 		}
+		for _, child := range files {
+			child.parent = file
+		}
 		insertFile(file)
 		return file
 	}
+
 	file := &File{
 		Lvl:      0,
 		Path:     name,
 		Filename: filename,
 		Size:     fileinfo.Size(),
+		Mtime:    fileinfo.ModTime().UnixNano(),
+		Dev:      dev,
+		Ino:      ino,
 		Group:    group,
 	}
+	if ino != 0 {
+		key := [2]uint64{dev, ino}
+		if canon, ok := inodeIndex[key]; ok {
+			file.hardlinkOf = canon
+		} else {
+			inodeIndex[key] = file
+		}
+	}
 	insertFile(file)
 	return file
 }
@@ -173,6 +422,7 @@ func analyze(dirname string, multi bool) {
 					continue
 				}
 			}
+			computeSlowHashes(item.Aliases)
 			m := make(map[string]Item, len(item.Aliases))
 			for _, file := range item.Aliases {
 				hash2, err := file.SlowHash()
@@ -196,16 +446,58 @@ func analyze(dirname string, multi bool) {
 						continue
 					}
 				}
+				distinct := reportHardlinks(dirname, item2.Aliases)
+				if len(distinct) >= 2 {
+					processGroup(dirname, distinct)
+				}
 				for _, file := range item2.Aliases {
-					fmt.Printf("%s\n", file.Path[len(dirname):])
 					removeFile(file)
 				}
-				fmt.Printf("\n")
 			}
 		}
 	}
 }
 
+// reportHardlinks splits a confirmed-duplicate group into clusters sharing
+// a (dev, ino) - pre-existing hardlinks, printed as an "H" line rather than
+// fed to processGroup - and returns one representative per distinct inode
+// for the caller to treat as an actual new duplicate.
+func reportHardlinks(dirname string, aliases []*File) []*File {
+	type inodeKey struct {
+		dev, ino uint64
+	}
+	groups := make(map[interface{}][]*File, len(aliases))
+	var order []interface{}
+	for _, file := range aliases {
+		var key interface{} = inodeKey{file.Dev, file.Ino}
+		if file.Ino == 0 {
+			key = file
+		}
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], file)
+	}
+	distinct := make([]*File, 0, len(order))
+	for _, key := range order {
+		group := groups[key]
+		if len(group) > 1 {
+			printHardlinkGroup(dirname, group)
+		}
+		distinct = append(distinct, group[0])
+	}
+	return distinct
+}
+
+func printHardlinkGroup(dirname string, group []*File) {
+	paths := make([]string, len(group))
+	for i, file := range group {
+		paths[i] = file.Path[len(dirname):]
+	}
+	sort.Strings(paths)
+	fmt.Printf("H %s\n", strings.Join(paths, " = "))
+}
+
 func insertFile(file *File) {
 	// Empty directory?
 	if file.Size == -1 && len(file.Children) == 0 {
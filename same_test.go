@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestHandleSymlinkHashesTargetNotContent guards against a symlink being
+// followed (and hashed by content) instead of being recorded as a symlink
+// whose SlowHash folds its target string.
+func TestHandleSymlinkHashesTargetNotContent(t *testing.T) {
+	resetScanState(t)
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "target.txt"), []byte("target content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("target.txt", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	fileinfo, err := os.Lstat(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanRootDev, _ = statDevIno(fileinfo)
+	tree := handle(root, fileinfo, 1)
+
+	link := childNamed(tree, "link")
+	if link == nil {
+		t.Fatal("link not found in scanned tree")
+	}
+	if link.LinkTarget != "target.txt" {
+		t.Errorf("LinkTarget = %q, want %q", link.LinkTarget, "target.txt")
+	}
+	if link.Size < 0 {
+		t.Error("a symlink should not be recorded as a directory")
+	}
+
+	linkHash, err := link.SlowHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := childNamed(tree, "target.txt")
+	targetHash, err := target.SlowHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if linkHash == targetHash {
+		t.Error("a symlink's SlowHash should not equal its target's content hash")
+	}
+}
+
+// TestHandleCanonicalizesHardlinks guards against two hardlinked paths
+// being hashed independently instead of sharing one SlowHash computation
+// via hardlinkOf.
+func TestHandleCanonicalizesHardlinks(t *testing.T) {
+	resetScanState(t)
+	root := t.TempDir()
+	a := filepath.Join(root, "a.txt")
+	b := filepath.Join(root, "b.txt")
+	if err := os.WriteFile(a, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(a, b); err != nil {
+		t.Fatal(err)
+	}
+
+	fileinfo, err := os.Lstat(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanRootDev, _ = statDevIno(fileinfo)
+	tree := handle(root, fileinfo, 1)
+
+	fa := childNamed(tree, "a.txt")
+	fb := childNamed(tree, "b.txt")
+	if fa == nil || fb == nil {
+		t.Fatal("a.txt or b.txt not found in scanned tree")
+	}
+	if fb.hardlinkOf != fa && fa.hardlinkOf != fb {
+		t.Error("hardlinked paths should canonicalize to the same File via hardlinkOf")
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// cmdUpdate reads a change stream on stdin and mutates the tree stored in
+// db in place, instead of re-walking the whole hierarchy like index does.
+//
+// The primary format is `zfs diff -FH` output: tab-separated lines
+//
+//	M	F	/path
+//	+	F	/path
+//	-	F	/path
+//	R	F	/old	/new
+//
+// for modify, add, remove and rename of a file (F) or directory (/).
+func cmdUpdate(args []string) {
+	fs := flag.NewFlagSet("same update", flag.ExitOnError)
+	hashName := fs.String("hash", slowHasher.Name(), "slow-hash algorithm; must match the one the index was written with")
+	hashSize := fs.Int("hash-size", defaultShakeSize, "output length in bytes for shake256; must match the one the index was written with")
+	fs.Parse(args)
+	rest := fs.Args()
+	if len(rest) < 1 {
+		fmt.Println("Usage: same update <db>")
+		return
+	}
+	db := rest[0]
+	h, err := lookupHasher(*hashName, *hashSize)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return
+	}
+	slowHasher = h
+
+	roots, err := loadIndex(db)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return
+	}
+	byPath := indexByPath(roots)
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		if err := applyDiffLine(byPath, scanner.Text()); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return
+	}
+
+	if err := saveIndex(db, roots); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+	}
+}
+
+// indexByPath walks every tree in roots and returns a lookup from a File's
+// full Path to the File itself.
+func indexByPath(roots []*File) map[string]*File {
+	byPath := make(map[string]*File)
+	var walk func(file *File)
+	walk = func(file *File) {
+		byPath[keyFor(file)] = file
+		for _, child := range file.Children {
+			walk(child)
+		}
+	}
+	for _, root := range roots {
+		walk(root)
+	}
+	return byPath
+}
+
+// keyFor normalizes a File's Path to a directory-slash-free form, matching
+// the paths zfs diff reports so map lookups agree for both files and
+// directories.
+func keyFor(file *File) string {
+	return strings.TrimSuffix(file.Path, "/")
+}
+
+func applyDiffLine(byPath map[string]*File, line string) error {
+	fields := strings.Split(line, "\t")
+	if len(fields) < 3 {
+		return fmt.Errorf("update: malformed diff line %q", line)
+	}
+	op, kind, name := fields[0], fields[1], fields[2]
+	isDir := kind == "/"
+
+	switch op {
+	case "M":
+		return applyModify(byPath, name, isDir)
+	case "+":
+		return applyAdd(byPath, name, isDir)
+	case "-":
+		return applyRemove(byPath, name)
+	case "R":
+		if len(fields) < 4 {
+			return fmt.Errorf("update: malformed rename line %q", line)
+		}
+		return applyRename(byPath, name, fields[3])
+	default:
+		return fmt.Errorf("update: unrecognized diff op %q", op)
+	}
+}
+
+func applyModify(byPath map[string]*File, name string, isDir bool) error {
+	file, ok := byPath[pathKey(name)]
+	if !ok {
+		return fmt.Errorf("update: modified path not in index: %s", name)
+	}
+	fileinfo, err := os.Lstat(name)
+	if err != nil {
+		return err
+	}
+	if isDir != fileinfo.IsDir() {
+		return fmt.Errorf("update: %s changed type between the diff and the filesystem", name)
+	}
+	invalidate(file)
+	// A directory's mtime changes whenever an entry is added or removed
+	// underneath it, but its own Size sentinel (-1) must never be
+	// clobbered with the raw stat size - only its children's hashes,
+	// which applyAdd/applyRemove/applyRename already keep current,
+	// determine its content.
+	if !isDir {
+		file.Size = fileinfo.Size()
+	}
+	file.Mtime = fileinfo.ModTime().UnixNano()
+	file.Dev, file.Ino = statDevIno(fileinfo)
+	revalidate(file)
+	return nil
+}
+
+func applyAdd(byPath map[string]*File, name string, isDir bool) error {
+	parent, ok := byPath[pathKey(path.Dir(name))]
+	if !ok {
+		return fmt.Errorf("update: parent of added path not in index: %s", name)
+	}
+	fileinfo, err := os.Lstat(name)
+	if err != nil {
+		return err
+	}
+	if isDir != fileinfo.IsDir() {
+		return fmt.Errorf("update: %s changed type between the diff and the filesystem", name)
+	}
+	invalidate(parent)
+	file := handle(name, fileinfo, parent.Group)
+	file.parent = parent
+	parent.Children = append(parent.Children, file)
+	if file.Lvl+1 > parent.Lvl {
+		parent.Lvl = file.Lvl + 1
+	}
+	for childPath, child := range indexByPath([]*File{file}) {
+		byPath[childPath] = child
+	}
+	revalidate(parent)
+	return nil
+}
+
+func applyRemove(byPath map[string]*File, name string) error {
+	file, ok := byPath[pathKey(name)]
+	if !ok {
+		return fmt.Errorf("update: removed path not in index: %s", name)
+	}
+	parent := file.parent
+	if parent == nil {
+		return fmt.Errorf("update: cannot remove a root from the index: %s", name)
+	}
+	detach(byPath, file)
+	for i, child := range parent.Children {
+		if child == file {
+			parent.Children = append(parent.Children[:i], parent.Children[i+1:]...)
+			break
+		}
+	}
+	invalidate(parent)
+	revalidate(parent)
+	return nil
+}
+
+func applyRename(byPath map[string]*File, oldName, newName string) error {
+	file, ok := byPath[pathKey(oldName)]
+	if !ok {
+		return fmt.Errorf("update: renamed path not in index: %s", oldName)
+	}
+	oldParent := file.parent
+	if oldParent == nil {
+		return fmt.Errorf("update: cannot rename a root in the index: %s", oldName)
+	}
+	newParent, ok := byPath[pathKey(path.Dir(newName))]
+	if !ok {
+		return fmt.Errorf("update: destination parent of rename not in index: %s", newName)
+	}
+
+	detach(byPath, file)
+	for i, child := range oldParent.Children {
+		if child == file {
+			oldParent.Children = append(oldParent.Children[:i], oldParent.Children[i+1:]...)
+			break
+		}
+	}
+	invalidate(oldParent)
+	revalidate(oldParent)
+
+	file.Filename = path.Base(newName)
+	reparent(byPath, file, newName)
+	file.parent = newParent
+	newParent.Children = append(newParent.Children, file)
+	if file.Lvl+1 > newParent.Lvl {
+		newParent.Lvl = file.Lvl + 1
+	}
+	invalidate(newParent)
+	revalidate(newParent)
+	return nil
+}
+
+// pathKey normalizes a diff line's path the same way handle/scan build
+// File.Path, so map lookups agree regardless of a trailing slash.
+func pathKey(name string) string {
+	return path.Clean(name)
+}
+
+// detach removes file and all of its descendants from byPath and from
+// levels, without touching file.parent.Children - the caller does that.
+func detach(byPath map[string]*File, file *File) {
+	removeFile(file)
+	deleteByPath(byPath, file)
+}
+
+func deleteByPath(byPath map[string]*File, file *File) {
+	delete(byPath, keyFor(file))
+	for _, child := range file.Children {
+		deleteByPath(byPath, child)
+	}
+}
+
+// reparent rewrites file.Path (and, recursively, every descendant's Path)
+// to live under newName, re-keying byPath to match.
+func reparent(byPath map[string]*File, file *File, newName string) {
+	if file.Size < 0 {
+		file.Path = newName + "/"
+	} else {
+		file.Path = newName
+	}
+	byPath[keyFor(file)] = file
+	for _, child := range file.Children {
+		reparent(byPath, child, path.Join(newName, child.Filename))
+	}
+}
+
+// invalidate clears the cached hashes of file and every ancestor up to the
+// root, removing each from its current bucket in levels first since that
+// bucket is keyed by the hash being invalidated.
+func invalidate(file *File) {
+	for node := file; node != nil; node = node.parent {
+		if node.fastHash != "" {
+			removeFromLevel(node)
+		}
+		node.fastHash = ""
+		node.slowHash = ""
+		node.slowErr = nil
+	}
+}
+
+// revalidate recomputes and reinserts file and every ancestor up to the
+// root, deepest first so each directory folds already-fresh child hashes.
+func revalidate(file *File) {
+	for node := file; node != nil; node = node.parent {
+		insertFile(node)
+	}
+}
+
+// removeFromLevel drops file from its current bucket in levels without
+// touching its children, using its still-cached fastHash to find the
+// bucket. Used by invalidate, which must vacate the old bucket before the
+// hash it was keyed on is cleared.
+func removeFromLevel(file *File) {
+	item := levels[file.Lvl][file.fastHash]
+	for i, alias := range item.Aliases {
+		if alias == file {
+			item.Aliases = append(item.Aliases[:i], item.Aliases[i+1:]...)
+			break
+		}
+	}
+	levels[file.Lvl][file.fastHash] = item
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestApplyModifyPreservesDirectorySentinel guards against a directory
+// modify line clobbering File.Size's -1 sentinel with the raw stat size,
+// which made SlowHash try to read the directory as a file afterward.
+func TestApplyModifyPreservesDirectorySentinel(t *testing.T) {
+	resetScanState(t)
+	root := t.TempDir()
+	sub := filepath.Join(root, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sub, "a.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fileinfo, err := os.Lstat(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanRootDev, _ = statDevIno(fileinfo)
+	tree := handle(root, fileinfo, 1)
+	byPath := indexByPath([]*File{tree})
+
+	// Touch the directory's mtime, as zfs diff does when an entry beneath
+	// it changes, and feed it through as a directory modify.
+	now := fileinfo.ModTime()
+	if err := os.Chtimes(sub, now, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyDiffLine(byPath, "M\t/\t"+sub); err != nil {
+		t.Fatal(err)
+	}
+
+	got := childNamed(tree, "sub")
+	if got == nil {
+		t.Fatal("sub not found after update")
+	}
+	if got.Size != -1 {
+		t.Errorf("sub.Size = %d after a directory M, want -1 (directory sentinel)", got.Size)
+	}
+	if _, err := got.SlowHash(); err != nil {
+		t.Errorf("SlowHash on the updated directory failed: %v", err)
+	}
+}
+
+// TestApplyModifyRejectsKindMismatch guards the sanity check that refuses
+// to apply a file-kind diff line against a path that's actually a
+// directory on disk, or vice versa.
+func TestApplyModifyRejectsKindMismatch(t *testing.T) {
+	resetScanState(t)
+	root := t.TempDir()
+	sub := filepath.Join(root, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	fileinfo, err := os.Lstat(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanRootDev, _ = statDevIno(fileinfo)
+	tree := handle(root, fileinfo, 1)
+	byPath := indexByPath([]*File{tree})
+
+	if err := applyDiffLine(byPath, "M\tF\t"+sub); err == nil {
+		t.Error("applyDiffLine should reject a file-kind M line against an actual directory")
+	}
+}